@@ -16,6 +16,9 @@ package splitter
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -41,25 +44,147 @@ type BucketIterator struct {
 	indexID      int64
 
 	dbConn *sql.DB
+
+	cancel           context.CancelFunc
+	producerDone     chan struct{}
+	producerFinished bool
+	// doneOnly is set when the checkpoint WAL shows a prior run already
+	// finished producing every chunk. produceChunks then skips straight
+	// to signaling completion instead of re-walking buckets.
+	doneOnly bool
+
+	spillCfg *SpillConfig
+	spiller  *chunkSpiller
+
+	strategy ChunkStrategy
+	// expectedRows is written by the producer goroutine and read by
+	// callers of ExpectedRows from whatever goroutine owns the
+	// iterator's consumer side, so access is guarded by
+	// expectedRowsMu. It is keyed by expectedRowsKey(c) rather than c
+	// itself: a chunk that gets spilled to disk and read back is a
+	// distinct *chunk.Range (gob decoding allocates a new one), so the
+	// original pointer would never be looked up again.
+	expectedRowsMu sync.Mutex
+	expectedRows   map[string]int64
+
+	workerPoolSize int
+
+	indexChooser IndexChooser
+
+	walCfg *WALOptions
+	wal    *checkpointWAL
+	// walMu guards walPending, which is written by the producer
+	// goroutine (registering a batch as it is sent) and by whatever
+	// goroutine(s) call Ack once they finish diffing a chunk.
+	walMu      sync.Mutex
+	walPending map[string]*walBatchState
+}
+
+// walBatchState tracks how many chunks from a single produced batch
+// are still unacknowledged, and the record to journal once the last
+// one is. It is shared by every chunk in the batch so any of them can
+// be the one that tips remaining to zero.
+type walBatchState struct {
+	remaining int
+	rec       walRecord
+}
+
+// Option configures optional behavior of a BucketIterator.
+type Option func(*BucketIterator)
+
+// WithSpillConfig makes the iterator spill produced chunk batches to
+// disk once its in-memory buffer exceeds cfg.MemLimit bytes, instead
+// of pinning all of them in memory while waiting for a slow consumer.
+func WithSpillConfig(cfg SpillConfig) Option {
+	return func(s *BucketIterator) {
+		s.spillCfg = &cfg
+	}
+}
+
+// WithChunkStrategy overrides how BucketIterator sizes the chunks it
+// splits buckets into. The default is FixedChunkStrategy, matching the
+// iterator's historical behavior.
+func WithChunkStrategy(strategy ChunkStrategy) Option {
+	return func(s *BucketIterator) {
+		s.strategy = strategy
+	}
 }
 
-func NewBucketIterator(ctx context.Context, table *common.TableDiff, dbConn *sql.DB, chunkSize int) (*BucketIterator, error) {
-	return NewBucketIteratorWithCheckpoint(ctx, table, dbConn, chunkSize, nil)
+func NewBucketIterator(ctx context.Context, table *common.TableDiff, dbConn *sql.DB, chunkSize int, opts ...Option) (*BucketIterator, error) {
+	return NewBucketIteratorWithCheckpoint(ctx, table, dbConn, chunkSize, nil, opts...)
 }
 
-func NewBucketIteratorWithCheckpoint(ctx context.Context, table *common.TableDiff, dbConn *sql.DB, chunkSize int, startRange *RangeInfo) (*BucketIterator, error) {
+func NewBucketIteratorWithCheckpoint(ctx context.Context, table *common.TableDiff, dbConn *sql.DB, chunkSize int, startRange *RangeInfo, opts ...Option) (*BucketIterator, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	bs := &BucketIterator{
-		table:     table,
-		chunkSize: int64(chunkSize),
-		chunksCh:  make(chan []*chunk.Range, DefaultChannelBuffer),
-		errCh:     make(chan error, 1),
-		dbConn:    dbConn,
+		table:        table,
+		chunkSize:    int64(chunkSize),
+		chunksCh:     make(chan []*chunk.Range, DefaultChannelBuffer),
+		errCh:        make(chan error, 1),
+		dbConn:       dbConn,
+		cancel:       cancel,
+		producerDone: make(chan struct{}),
+		expectedRows: make(map[string]int64),
+		walPending:   make(map[string]*walBatchState),
+	}
+
+	for _, opt := range opts {
+		opt(bs)
+	}
+
+	if bs.spillCfg != nil {
+		spiller, err := newChunkSpiller(*bs.spillCfg)
+		if err != nil {
+			cancel()
+			return nil, errors.Trace(err)
+		}
+		bs.spiller = spiller
+	}
+
+	if bs.walCfg != nil {
+		wal, err := newCheckpointWAL(*bs.walCfg)
+		if err != nil {
+			cancel()
+			return nil, errors.Trace(err)
+		}
+		bs.wal = wal
+
+		if startRange == nil {
+			replayed, err := replayLastWALRecord(bs.walCfg.Dir)
+			if err != nil {
+				cancel()
+				return nil, errors.Trace(err)
+			}
+			switch {
+			case replayed == nil:
+				// Nothing checkpointed yet; produce from the beginning.
+			case replayed.Done:
+				// The prior run's last record marks every bucket as
+				// already produced, so there is nothing left to resume:
+				// skip straight to signaling completion.
+				bs.doneOnly = true
+				log.Info("checkpoint WAL shows bucket iteration already completed, nothing to resume",
+					zap.Int64("indexID", replayed.IndexID))
+			default:
+				startRange, err = rangeInfoFromWALRecord(table, replayed)
+				if err != nil {
+					cancel()
+					return nil, errors.Trace(err)
+				}
+				log.Info("resuming bucket iterator from checkpoint WAL",
+					zap.Int64("indexID", replayed.IndexID), zap.Int("bucketID", replayed.BucketID))
+			}
+		}
 	}
 
 	if err := bs.init(startRange); err != nil {
+		cancel()
 		return nil, errors.Trace(err)
 	}
-	go bs.produceChunks(ctx, startRange)
+	go func() {
+		defer close(bs.producerDone)
+		bs.produceChunks(ctx, startRange)
+	}()
 
 	return bs, nil
 }
@@ -68,20 +193,75 @@ func (s *BucketIterator) GetIndexID() int64 {
 	return s.indexID
 }
 
+// ExpectedRows returns the row count the chunk strategy estimated for
+// c when it was produced, so downstream diff workers can schedule
+// heavier chunks accordingly. It returns (0, false) when no estimate
+// was recorded for c.
+func (s *BucketIterator) ExpectedRows(c *chunk.Range) (int64, bool) {
+	s.expectedRowsMu.Lock()
+	defer s.expectedRowsMu.Unlock()
+	rows, ok := s.expectedRows[expectedRowsKey(c)]
+	return rows, ok
+}
+
+// Ack acknowledges that the caller has finished diffing c. Once every
+// chunk from the batch c was produced in has been acked, the
+// checkpoint WAL journals that batch, so a crash resumes from the
+// last batch the consumer actually finished diffing rather than the
+// last one the producer happened to emit: without this, a chunk that
+// was produced (and checkpointed) but not yet diffed at crash time
+// would be silently skipped by a run that resumes past it, instead of
+// being re-produced and re-diffed. Ack is a no-op when no WAL is
+// configured, or when c does not belong to a still-pending batch
+// (e.g. it was already acked, or c came from an iterator with no WAL).
+func (s *BucketIterator) Ack(c *chunk.Range) error {
+	if s.wal == nil {
+		return nil
+	}
+
+	key := expectedRowsKey(c)
+	s.walMu.Lock()
+	state, ok := s.walPending[key]
+	if !ok {
+		s.walMu.Unlock()
+		return nil
+	}
+	delete(s.walPending, key)
+	state.remaining--
+	ready := state.remaining == 0
+	s.walMu.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return errors.Trace(s.wal.Append(state.rec))
+}
+
+// registerWALBatch records that rec should be journaled once every
+// chunk in chunks has been acknowledged via Ack, instead of
+// journaling it immediately when the batch is sent: the WAL is a
+// meaningful resume point only once the consumer has actually caught
+// up to it, not merely once the producer emitted it.
+func (s *BucketIterator) registerWALBatch(chunks []*chunk.Range, rec walRecord) {
+	if len(chunks) == 0 {
+		return
+	}
+	state := &walBatchState{remaining: len(chunks), rec: rec}
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	for _, c := range chunks {
+		s.walPending[expectedRowsKey(c)] = state
+	}
+}
+
 func (s *BucketIterator) Next() (*chunk.Range, error) {
 	if uint(len(s.chunks)) <= s.nextChunk {
-		select {
-		case err := <-s.errCh:
+		if err := s.fetchNextBatch(); err != nil {
 			return nil, errors.Trace(err)
-		case s.chunks = <-s.chunksCh:
-			if s.chunks == nil {
-				log.Info("close chunks channel for table",
-					zap.String("schema", s.table.Schema), zap.String("table", s.table.Table))
-				close(s.chunksCh)
-				return nil, nil
-			}
 		}
-		s.nextChunk = 0
+		if s.chunks == nil {
+			return nil, nil
+		}
 	}
 
 	c := s.chunks[s.nextChunk]
@@ -89,6 +269,77 @@ func (s *BucketIterator) Next() (*chunk.Range, error) {
 	return c, nil
 }
 
+// fetchNextBatch refills s.chunks with the next batch of chunks,
+// either straight off chunksCh or, once chunksCh holds no earlier
+// batch and some batches were spilled to disk under memory pressure,
+// by paging them back in from the spill file in the order they were
+// produced.
+func (s *BucketIterator) fetchNextBatch() error {
+	s.nextChunk = 0
+	prevChunks := s.chunks
+
+	if s.producerFinished {
+		if s.spiller != nil {
+			chunks, err := s.spiller.Pop()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			s.chunks = chunks
+		} else {
+			s.chunks = nil
+		}
+		s.pruneExpectedRows(prevChunks)
+		return nil
+	}
+
+	// Once spilling goes sticky (see chunkSpiller.spilling), nothing
+	// more arrives on chunksCh until the producer's final nil, so once
+	// the batches buffered there before the first spill are drained,
+	// read whatever has already been spilled instead of blocking:
+	// otherwise a consumer that could keep making progress against the
+	// spill file would stall until production finishes.
+	if s.spiller != nil && s.spiller.Pending() && len(s.chunksCh) == 0 {
+		chunks, err := s.spiller.Pop()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s.chunks = chunks
+		s.pruneExpectedRows(prevChunks)
+		return nil
+	}
+
+	var spilled <-chan struct{}
+	if s.spiller != nil {
+		spilled = s.spiller.notify
+	}
+	select {
+	case err := <-s.errCh:
+		return errors.Trace(err)
+	case s.chunks = <-s.chunksCh:
+		if s.chunks != nil && s.spiller != nil {
+			// This batch went straight to chunksCh rather than being
+			// spilled, so it was counted by trackInMem; now that the
+			// consumer has actually drained it, it is no longer
+			// resident and must not keep counting toward MemLimit.
+			s.spiller.untrackInMem(estimateChunksSize(s.chunks))
+		}
+		s.pruneExpectedRows(prevChunks)
+		if s.chunks != nil {
+			return nil
+		}
+
+		log.Info("close chunks channel for table",
+			zap.String("schema", s.table.Schema), zap.String("table", s.table.Table))
+		close(s.chunksCh)
+		s.producerFinished = true
+		return s.fetchNextBatch()
+	case <-spilled:
+		// A batch was spilled while we were waiting; loop back around
+		// to pick it up via the Pending() check above.
+		return s.fetchNextBatch()
+	}
+}
+
 func (s *BucketIterator) init(startRange *RangeInfo) error {
 	s.nextChunk = 0
 	buckets, err := dbutil.GetBucketsInfo(context.Background(), s.dbConn, s.table.Schema, s.table.Table, s.table.Info)
@@ -96,8 +347,8 @@ func (s *BucketIterator) init(startRange *RangeInfo) error {
 		return errors.Trace(err)
 	}
 	// TODO: 1. ignore some columns
-	//		 2. how to choose index
 	indices := dbutil.FindAllIndex(s.table.Info)
+	var candidates []IndexCandidate
 	for _, index := range indices {
 		if index == nil {
 			continue
@@ -112,20 +363,36 @@ func (s *BucketIterator) init(startRange *RangeInfo) error {
 		log.Debug("buckets for index", zap.String("index", index.Name.O), zap.Reflect("buckets", buckets))
 
 		indexColumns := utils.GetColumnsFromIndex(index, s.table.Info)
-
 		if len(indexColumns) == 0 {
 			continue
 		}
-		s.buckets = bucket
-		s.indexColumns = indexColumns
-		s.indexID = index.ID
-		break
+		candidates = append(candidates, IndexCandidate{Index: index, Columns: indexColumns, Buckets: bucket})
+
+		// Resuming from a checkpoint must stick to the index the
+		// checkpoint was taken against, so there is nothing to choose.
+		if startRange != nil {
+			break
+		}
 	}
 
-	if s.buckets == nil || s.indexColumns == nil {
+	if len(candidates) == 0 {
 		return errors.NotFoundf("no index to split buckets")
 	}
 
+	if s.indexChooser == nil {
+		s.indexChooser = scoringIndexChooser{}
+	}
+	chosen, err := s.indexChooser.Choose(s.table, candidates)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Debug("chose index to split buckets",
+		zap.String("index", chosen.Index.Name.O), zap.Int("alternatives", len(candidates)-1))
+
+	s.buckets = chosen.Buckets
+	s.indexColumns = chosen.Columns
+	s.indexID = chosen.Index.ID
+
 	// There are only 10k chunks at most
 	if s.chunkSize <= 0 {
 		var cnt int64 = 0
@@ -139,25 +406,79 @@ func (s *BucketIterator) init(startRange *RangeInfo) error {
 		s.chunkSize = chunkSize
 	}
 
+	if s.strategy == nil {
+		s.strategy = &FixedChunkStrategy{}
+	}
+	s.strategy.Init(s.buckets, s.chunkSize)
+
 	return nil
 }
 
+// Close stops the background producer goroutine and removes any temp
+// file created to spill chunk batches to disk.
 func (s *BucketIterator) Close() {
+	s.cancel()
+	// Drain a producer that may be parked trying to send the next
+	// batch (or the final nil) on chunksCh, so it can observe ctx.Done
+	// and exit instead of leaking.
+	go func() {
+		for {
+			select {
+			case <-s.chunksCh:
+			case <-s.producerDone:
+				return
+			}
+		}
+	}()
+	<-s.producerDone
+	select {
+	case <-s.errCh:
+	default:
+	}
+
+	if s.spiller != nil {
+		if err := s.spiller.Close(); err != nil {
+			log.Warn("failed to remove bucket iterator spill file", zap.Error(err))
+		}
+	}
+
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			log.Warn("failed to close checkpoint WAL", zap.Error(err))
+		}
+	}
 }
 
 func (s *BucketIterator) produceChunks(ctx context.Context, startRange *RangeInfo) {
+	if s.doneOnly {
+		select {
+		case s.chunksCh <- nil:
+		case <-ctx.Done():
+		}
+		return
+	}
+
 	var (
 		lowerValues, upperValues []string
 		latestCount              int64
 		err                      error
 	)
 	chunkSize := s.chunkSize
-	halfChunkSize := chunkSize / 2
 	table := s.table
 	buckets := s.buckets
 	indexColumns := s.indexColumns
 	chunkID := 0
 	beginBucket := 0
+	if startRange != nil && int(startRange.GetChunk().BucketID) >= len(buckets) {
+		// The checkpoint's bucket index no longer exists against the
+		// current bucket stats (e.g. they were refreshed between runs).
+		// There is no precise point to resume from, so fall back to
+		// splitting the whole table again rather than indexing out of
+		// range below.
+		log.Warn("checkpoint bucket index is out of range for current bucket stats, restarting bucket split",
+			zap.Int("bucketID", int(startRange.GetChunk().BucketID)), zap.Int("buckets", len(buckets)))
+		startRange = nil
+	}
 	if startRange != nil {
 		chunkRange := chunk.NewChunkRange()
 		c := startRange.GetChunk()
@@ -179,26 +500,46 @@ func (s *BucketIterator) produceChunks(ctx context.Context, startRange *RangeInf
 			return
 		}
 		if count > 0 {
-			chunkCnt := int((count + halfChunkSize) / chunkSize)
+			// This run covers exactly the single bucket c was split from.
+			chunkCnt := s.chunkCount(count, 1)
 			chunks, err := splitRangeByRandom(s.dbConn, chunkRange, chunkCnt, table.Schema, table.Table, indexColumns, table.Range, table.Collation)
 			if err != nil {
 				s.errCh <- errors.Trace(err)
 				return
 			}
 			chunkID = chunk.InitChunks(chunks, chunk.Bucket, chunkID, c.BucketID, table.Collation, table.Range)
-			s.chunksCh <- chunks
-
+			s.recordExpectedRows(chunks, count)
+			if !s.sendChunks(ctx, chunks, c.BucketID, chunkID) {
+				return
+			}
 		}
 		latestCount = buckets[c.BucketID].Count
 		beginBucket = int(c.BucketID + 1)
-		lowerValues, err = dbutil.AnalyzeValuesFromBuckets(buckets[beginBucket].LowerBound, indexColumns)
-		if err != nil {
-			s.errCh <- errors.Trace(err)
-			return
+		// beginBucket can land on len(buckets) when c was the last
+		// bucket, in which case there is nothing left to merge below.
+		if beginBucket < len(buckets) {
+			lowerValues, err = dbutil.AnalyzeValuesFromBuckets(buckets[beginBucket].LowerBound, indexColumns)
+			if err != nil {
+				s.errCh <- errors.Trace(err)
+				return
+			}
 		}
 	}
 	chunkRange := chunk.NewChunkRange()
+	// Enumerating bucket ranges and deciding where to merge skinny
+	// buckets together is cheap local work, so it stays sequential
+	// here; only the splitJobs it produces -- each an expensive
+	// `SELECT ... ORDER BY ... LIMIT` against the DB -- get farmed out
+	// to the worker pool below.
 	// TODO chunksize when checkpoint
+	jobs := make([]splitJob, 0, len(buckets)-beginBucket)
+	// prevIdx is the index of the bucket latestCount was last measured
+	// at (beginBucket-1, or the checkpointed bucket when resuming), so
+	// i-prevIdx is how many buckets this run merges together. The
+	// strategy's skew statistics are per single bucket, so ChunkSize
+	// needs that span to compare on the same granularity instead of
+	// against a merged run's much larger total count.
+	prevIdx := beginBucket - 1
 	for i := beginBucket; i < len(buckets); i++ {
 		count := buckets[i].Count - latestCount
 		if count < chunkSize {
@@ -228,18 +569,25 @@ func (s *BucketIterator) produceChunks(ctx context.Context, startRange *RangeInf
 		//            count                     chunkCnt
 		// 0 ... 0.5x ... x ... 1.5x   ------->   1
 		//       1.5x ... 2x ... 2.5x  ------->   2
-		chunkCnt := int((count + halfChunkSize) / chunkSize)
-		chunks, err := splitRangeByRandom(s.dbConn, chunkRange, chunkCnt, table.Schema, table.Table, indexColumns, table.Range, table.Collation)
-		if err != nil {
-			s.errCh <- errors.Trace(err)
-			return
-		}
+		jobs = append(jobs, splitJob{
+			bucketIdx:  i,
+			chunkRange: chunkRange,
+			chunkCnt:   s.chunkCount(count, i-prevIdx),
+			count:      count,
+		})
 
 		chunkRange = chunk.NewChunkRange()
 		latestCount = buckets[i].Count
 		lowerValues = upperValues
-		chunkID = chunk.InitChunks(chunks, chunk.Bucket, chunkID, i, table.Collation, table.Range)
-		s.chunksCh <- chunks
+		prevIdx = i
+	}
+
+	if err := s.runSplitJobs(ctx, jobs, &chunkID); err != nil {
+		select {
+		case s.errCh <- errors.Trace(err):
+		case <-ctx.Done():
+		}
+		return
 	}
 
 	// merge the rest keys into one chunk
@@ -249,9 +597,146 @@ func (s *BucketIterator) produceChunks(ctx context.Context, startRange *RangeInf
 		}
 		chunks := []*chunk.Range{chunkRange}
 		chunkID = chunk.InitChunks(chunks, chunk.Bucket, chunkID, len(buckets), table.Collation, table.Range)
-		s.chunksCh <- chunks
+		// This batch has no bucket index past the last one to resume
+		// from on a crash, so it is journaled as a Done record rather
+		// than a normal per-bucket checkpoint (which replayed as
+		// BucketID == len(buckets) and panicked indexing buckets[...]
+		// on resume).
+		if !s.sendFinalChunks(ctx, chunks) {
+			return
+		}
 	}
 
 	// send `nil` to notify consumer that none of chunk is left.
-	s.chunksCh <- nil
+	select {
+	case s.chunksCh <- nil:
+	case <-ctx.Done():
+	}
+}
+
+// chunkCount asks the configured ChunkStrategy how many rows to target
+// per chunk for a run of numBuckets merged buckets holding count rows
+// in total, and converts that into a chunk count the same way the
+// fixed-size path always has.
+func (s *BucketIterator) chunkCount(count int64, numBuckets int) int {
+	size := s.strategy.ChunkSize(count, numBuckets)
+	if size <= 0 {
+		size = 1
+	}
+	return int((count + size/2) / size)
+}
+
+// recordExpectedRows remembers the estimated row count for each chunk
+// in a freshly produced batch, splitting count evenly across them.
+func (s *BucketIterator) recordExpectedRows(chunks []*chunk.Range, count int64) {
+	if len(chunks) == 0 {
+		return
+	}
+	rows := count / int64(len(chunks))
+	s.expectedRowsMu.Lock()
+	defer s.expectedRowsMu.Unlock()
+	for _, c := range chunks {
+		s.expectedRows[expectedRowsKey(c)] = rows
+	}
+}
+
+// pruneExpectedRows drops chunks' entries from expectedRows once
+// fetchNextBatch is moving past them, i.e. once every chunk in the
+// batch has already been handed out by Next. Without this,
+// expectedRows would grow by one entry per chunk for the iterator's
+// entire lifetime, reintroducing the unbounded-memory problem the
+// disk spiller exists to avoid on tables with millions of chunks.
+func (s *BucketIterator) pruneExpectedRows(chunks []*chunk.Range) {
+	if len(chunks) == 0 {
+		return
+	}
+	s.expectedRowsMu.Lock()
+	defer s.expectedRowsMu.Unlock()
+	for _, c := range chunks {
+		delete(s.expectedRows, expectedRowsKey(c))
+	}
+}
+
+// expectedRowsKey derives a stable key for c's entry in expectedRows
+// from its bucket index and upper bounds rather than its pointer
+// identity, so the lookup still succeeds after c has been through a
+// disk-spill gob round trip (which allocates a new *chunk.Range with
+// the same bounds but a different address).
+func expectedRowsKey(c *chunk.Range) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%d", c.BucketID)
+	for _, b := range c.Bounds {
+		key.WriteByte(0)
+		key.WriteString(b.Upper)
+	}
+	return key.String()
+}
+
+// sendChunks delivers a batch of chunks to the consumer, transparently
+// spilling it to disk instead of chunksCh once the configured memory
+// budget has been exceeded, and registers the batch's checkpoint
+// record to be journaled once every chunk in it has been acknowledged
+// via Ack, when a WAL is configured. It returns false if ctx was
+// canceled before the batch could be handed off, in which case the
+// caller should stop producing. bucketID and chunkID identify this
+// batch for the WAL record: the bucket it was split from and the
+// running chunk ID counter after the batch.
+func (s *BucketIterator) sendChunks(ctx context.Context, chunks []*chunk.Range, bucketID int, chunkID int) bool {
+	if s.wal != nil && len(chunks) > 0 {
+		s.registerWALBatch(chunks, buildWALRecord(s.indexID, bucketID, chunkID, chunks[len(chunks)-1]))
+	}
+	return s.deliverChunks(ctx, chunks)
+}
+
+// sendFinalChunks delivers the terminal "merge the rest keys" batch the
+// same way sendChunks does, but registers completion rather than a
+// normal per-bucket checkpoint: there is no further bucket to resume
+// from, so once this batch is fully acked production is done.
+func (s *BucketIterator) sendFinalChunks(ctx context.Context, chunks []*chunk.Range) bool {
+	if s.wal != nil {
+		s.registerWALBatch(chunks, walRecord{IndexID: s.indexID, Done: true})
+	}
+	return s.deliverChunks(ctx, chunks)
+}
+
+// deliverChunks hands a batch to the consumer, spilling to disk instead
+// of chunksCh once the configured memory budget has been exceeded.
+func (s *BucketIterator) deliverChunks(ctx context.Context, chunks []*chunk.Range) bool {
+	if s.spiller != nil {
+		size := estimateChunksSize(chunks)
+		if s.spiller.shouldSpill(size) {
+			if err := s.spiller.Push(chunks); err != nil {
+				select {
+				case s.errCh <- errors.Trace(err):
+				case <-ctx.Done():
+				}
+				return false
+			}
+			return true
+		}
+		s.spiller.trackInMem(size)
+	}
+
+	select {
+	case s.chunksCh <- chunks:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// buildWALRecord constructs (without writing) the checkpoint record
+// describing the last chunk of a freshly produced batch, for
+// registerWALBatch to journal once the batch has been fully acked.
+func buildWALRecord(indexID int64, bucketID int, chunkID int, last *chunk.Range) walRecord {
+	upperBoundValues := make([]string, len(last.Bounds))
+	for i, bound := range last.Bounds {
+		upperBoundValues[i] = bound.Upper
+	}
+	return walRecord{
+		IndexID:          indexID,
+		BucketID:         bucketID,
+		ChunkID:          chunkID,
+		UpperBoundValues: upperBoundValues,
+	}
 }
\ No newline at end of file
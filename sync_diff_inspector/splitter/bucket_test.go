@@ -0,0 +1,149 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/chunk"
+)
+
+func newTestWALIterator(t *testing.T) *BucketIterator {
+	t.Helper()
+	wal, err := newCheckpointWAL(WALOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("newCheckpointWAL: %v", err)
+	}
+	t.Cleanup(func() { wal.Close() })
+	return &BucketIterator{
+		indexID:    7,
+		wal:        wal,
+		walPending: make(map[string]*walBatchState),
+	}
+}
+
+// TestAckOnlyJournalsOnceBatchIsFullyAcked pins down the fix for the
+// produced-vs-consumed gap: the WAL must not record a batch as done
+// until every chunk in it has actually been acknowledged, not merely
+// produced, since an un-acked chunk at crash time means the consumer
+// never diffed it.
+func TestAckOnlyJournalsOnceBatchIsFullyAcked(t *testing.T) {
+	s := newTestWALIterator(t)
+
+	c1 := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "10"}}}
+	c2 := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "20"}}}
+	chunks := []*chunk.Range{c1, c2}
+	s.registerWALBatch(chunks, buildWALRecord(s.indexID, 1, 2, c2))
+
+	if err := s.Ack(c1); err != nil {
+		t.Fatalf("Ack c1: %v", err)
+	}
+	if replayed, err := replayLastWALRecord(s.wal.opts.Dir); err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	} else if replayed != nil {
+		t.Fatalf("expected no WAL record before every chunk in the batch is acked, got %+v", replayed)
+	}
+
+	if err := s.Ack(c2); err != nil {
+		t.Fatalf("Ack c2: %v", err)
+	}
+	replayed, err := replayLastWALRecord(s.wal.opts.Dir)
+	if err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	}
+	if replayed == nil || replayed.BucketID != 1 || replayed.ChunkID != 2 {
+		t.Fatalf("expected the batch's record once fully acked, got %+v", replayed)
+	}
+}
+
+func TestAckIsNoOpWithoutWAL(t *testing.T) {
+	s := &BucketIterator{}
+	c := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "10"}}}
+	if err := s.Ack(c); err != nil {
+		t.Fatalf("expected Ack to be a no-op without a WAL, got %v", err)
+	}
+}
+
+func TestAckUnknownChunkIsNoOp(t *testing.T) {
+	s := newTestWALIterator(t)
+	c := &chunk.Range{BucketID: 9, Bounds: []*chunk.Bound{{Column: "a", Upper: "90"}}}
+	if err := s.Ack(c); err != nil {
+		t.Fatalf("expected Ack of an unregistered chunk to be a no-op, got %v", err)
+	}
+}
+
+// TestExpectedRowsKeySurvivesGobRoundTrip pins down the reason
+// expectedRows is keyed by expectedRowsKey(c) instead of c itself: a
+// chunk spilled to disk and read back is a distinct *chunk.Range with
+// the same bounds, so the key must still match after a gob round trip
+// even though the pointer does not.
+func TestExpectedRowsKeySurvivesGobRoundTrip(t *testing.T) {
+	original := &chunk.Range{
+		BucketID: 3,
+		Bounds: []*chunk.Bound{
+			{Column: "a", Upper: "10"},
+			{Column: "b", Upper: "foo"},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(original); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var decoded *chunk.Range
+	if err := gob.NewDecoder(buf).Decode(&decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if decoded == original {
+		t.Fatalf("expected gob decoding to allocate a new *chunk.Range")
+	}
+	if expectedRowsKey(original) != expectedRowsKey(decoded) {
+		t.Fatalf("expectedRowsKey mismatch after gob round trip: %q != %q",
+			expectedRowsKey(original), expectedRowsKey(decoded))
+	}
+}
+
+func TestExpectedRowsKeyDistinguishesChunksInSameBucket(t *testing.T) {
+	a := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "10"}}}
+	b := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "20"}}}
+	if expectedRowsKey(a) == expectedRowsKey(b) {
+		t.Fatalf("expected distinct keys for chunks with different upper bounds in the same bucket")
+	}
+}
+
+// TestPruneExpectedRowsRemovesOnlyGivenChunks pins down that pruning a
+// consumed batch only drops that batch's entries, so expectedRows
+// doesn't grow without bound across a long-running iterator but also
+// doesn't lose an estimate for a chunk that hasn't been consumed yet.
+func TestPruneExpectedRowsRemovesOnlyGivenChunks(t *testing.T) {
+	consumed := &chunk.Range{BucketID: 1, Bounds: []*chunk.Bound{{Column: "a", Upper: "10"}}}
+	pending := &chunk.Range{BucketID: 2, Bounds: []*chunk.Bound{{Column: "a", Upper: "20"}}}
+
+	s := &BucketIterator{expectedRows: map[string]int64{
+		expectedRowsKey(consumed): 100,
+		expectedRowsKey(pending):  200,
+	}}
+
+	s.pruneExpectedRows([]*chunk.Range{consumed})
+
+	if _, ok := s.ExpectedRows(consumed); ok {
+		t.Fatalf("expected consumed chunk's entry to be pruned")
+	}
+	if rows, ok := s.ExpectedRows(pending); !ok || rows != 200 {
+		t.Fatalf("expected pending chunk's entry to survive pruning, got rows=%d ok=%v", rows, ok)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+)
+
+func bucketsFromCounts(counts ...int64) []dbutil.Bucket {
+	buckets := make([]dbutil.Bucket, len(counts))
+	var cumulative int64
+	for i, c := range counts {
+		cumulative += c
+		buckets[i] = dbutil.Bucket{Count: cumulative}
+	}
+	return buckets
+}
+
+func TestAdaptiveChunkStrategyUniformBucketsUseBaseline(t *testing.T) {
+	a := &AdaptiveChunkStrategy{}
+	a.Init(bucketsFromCounts(100, 100, 100, 100), 1000)
+
+	if size := a.ChunkSize(100, 1); size != 1000 {
+		t.Fatalf("expected baseline size for a non-skewed run, got %d", size)
+	}
+}
+
+func TestAdaptiveChunkStrategyShrinksSkewedRun(t *testing.T) {
+	a := &AdaptiveChunkStrategy{}
+	// One bucket is far denser than the rest, so its stddev-based
+	// threshold should flag it as skewed and shrink its chunk size.
+	a.Init(bucketsFromCounts(100, 100, 100, 100, 10000), 1000)
+
+	size := a.ChunkSize(10000, 1)
+	if size >= 1000 {
+		t.Fatalf("expected a skewed run to shrink below the baseline, got %d", size)
+	}
+	if size < SplitThreshold {
+		t.Fatalf("chunk size must never drop below SplitThreshold, got %d", size)
+	}
+}
+
+// TestAdaptiveChunkStrategyMergedUniformRunUsesBaseline pins the bug a
+// previous version of ChunkSize had: it compared a merged run's total
+// count directly against a per-single-bucket threshold, so a uniform
+// table whose buckets are each much smaller than the baseline chunk
+// size (and so get merged hundreds at a time) always looked skewed,
+// even though none of its individual buckets are. Dividing by the
+// run's bucket span before comparing should keep it at baseline.
+func TestAdaptiveChunkStrategyMergedUniformRunUsesBaseline(t *testing.T) {
+	counts := make([]int64, 500)
+	for i := range counts {
+		counts[i] = 10
+	}
+	a := &AdaptiveChunkStrategy{}
+	a.Init(bucketsFromCounts(counts...), 1000)
+
+	// 500 buckets of 10 rows each merged into one run: same per-bucket
+	// density as Init saw, just a much larger total.
+	if size := a.ChunkSize(5000, 500); size != 1000 {
+		t.Fatalf("expected a merged run of uniformly-sized buckets to use the baseline, got %d", size)
+	}
+}
+
+func TestAdaptiveChunkStrategyNoBuckets(t *testing.T) {
+	a := &AdaptiveChunkStrategy{}
+	a.Init(nil, 1000)
+	if size := a.ChunkSize(5000, 1); size != 1000 {
+		t.Fatalf("expected baseline when there are no buckets to measure skew against, got %d", size)
+	}
+}
+
+func TestAdaptiveChunkStrategyZeroBucketsFallsBackToBaseline(t *testing.T) {
+	a := &AdaptiveChunkStrategy{}
+	a.Init(bucketsFromCounts(100, 100, 100, 100, 10000), 1000)
+
+	if size := a.ChunkSize(10000, 0); size != 1000 {
+		t.Fatalf("expected baseline when numBuckets is 0, got %d", size)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/source/common"
+	"go.uber.org/zap"
+)
+
+// IndexCandidate is an index eligible to split buckets by, together
+// with the statistics an IndexChooser needs to score it.
+type IndexCandidate struct {
+	Index   *model.IndexInfo
+	Columns []*model.ColumnInfo
+	Buckets []dbutil.Bucket
+}
+
+// IndexChooser picks which of several candidate indices BucketIterator
+// should split buckets on. The default, scoringIndexChooser, replaces
+// the historical "pick whichever index comes first" behavior.
+type IndexChooser interface {
+	Choose(table *common.TableDiff, candidates []IndexCandidate) (*IndexCandidate, error)
+}
+
+// WithIndexChooser overrides how BucketIterator picks which index to
+// split buckets by when a table has more than one indexed column with
+// bucket statistics available. The default is a scoringIndexChooser.
+func WithIndexChooser(chooser IndexChooser) Option {
+	return func(s *BucketIterator) {
+		s.indexChooser = chooser
+	}
+}
+
+// scoringIndexChooser ranks candidates by bucket count (as an NDV
+// proxy; bucket row counts and index NDV statistics are not read),
+// leading-column width, collation match, and uniqueness -- normalized
+// onto a common scale so no single term dominates by raw magnitude --
+// and picks the highest-scoring one. It is the default IndexChooser.
+type scoringIndexChooser struct{}
+
+// Weights are applied to terms that are first normalized to [0, 1]
+// (see normalizeScores), so they are directly comparable: wNDV and
+// wWidth trade off against each other on equal footing, and
+// wUnique/wCollation are flat bonuses on that same [0, 1] scale rather
+// than raw quantities that could swamp the others depending on table
+// size or column width.
+const (
+	// scoreWeightNDV rewards indices whose buckets carve the table
+	// into more slices (how evenly rows spread across them is not
+	// measured) -- a proxy for higher cardinality, since
+	// dbutil.GetBucketsInfo returns one bucket per distinct histogram
+	// step and low-NDV indices (e.g. a status enum) collapse into few.
+	scoreWeightNDV = 0.5
+	// scoreWeightWidth rewards a narrower leading column, which is
+	// cheaper to compare and fits more split points in a query.
+	scoreWeightWidth = 0.3
+	// scoreWeightUnique rewards a unique/PK index, which guarantees the
+	// bucket boundaries are actually distinct split points.
+	scoreWeightUnique = 0.15
+	// scoreWeightCollation rewards a leading column whose collation
+	// matches the table's, avoiding collation-aware comparisons when
+	// building WHERE clauses for the chunk range.
+	scoreWeightCollation = 0.05
+)
+
+func (scoringIndexChooser) Choose(table *common.TableDiff, candidates []IndexCandidate) (*IndexCandidate, error) {
+	if len(candidates) == 0 {
+		return nil, errors.NotFoundf("no index to split buckets")
+	}
+
+	scores := scoreIndexCandidates(table, candidates)
+	best := 0
+	for i, c := range candidates {
+		log.Debug("scored index candidate", zap.String("index", c.Index.Name.O), zap.Float64("score", scores[i]))
+		if scores[i] > scores[best] {
+			best = i
+		}
+	}
+	return &candidates[best], nil
+}
+
+// scoreIndexCandidates scores every candidate for table, normalizing
+// the bucket-count and leading-column-width terms across the
+// candidate set first (min-max to [0, 1]) so neither term's raw
+// magnitude -- which depends on the table's bucket count and the
+// column's declared width, not on how good a split point the index
+// is -- ends up dominating the other or the flat unique/collation
+// bonuses.
+func scoreIndexCandidates(table *common.TableDiff, candidates []IndexCandidate) []float64 {
+	ndv := make([]float64, len(candidates))
+	width := make([]float64, len(candidates))
+	for i, c := range candidates {
+		ndv[i] = float64(len(c.Buckets))
+		width[i] = leadingColumnWidth(c.Columns[0])
+	}
+	normNDV := normalizeScores(ndv)
+	normWidth := normalizeScores(width)
+
+	scores := make([]float64, len(candidates))
+	for i, c := range candidates {
+		score := scoreWeightNDV*normNDV[i] + scoreWeightWidth*(1-normWidth[i])
+		if c.Index.Primary || c.Index.Unique {
+			score += scoreWeightUnique
+		}
+		if len(c.Columns[0].FieldType.Collate) > 0 && c.Columns[0].FieldType.Collate == table.Collation {
+			score += scoreWeightCollation
+		}
+		scores[i] = score
+	}
+	return scores
+}
+
+// normalizeScores min-max scales values to [0, 1]. When every value is
+// equal (including the single-candidate case), the term carries no
+// discriminating signal, so every entry normalizes to 0 rather than
+// introducing an arbitrary 1.0.
+func normalizeScores(values []float64) []float64 {
+	min, max := values[0], values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	normalized := make([]float64, len(values))
+	if max == min {
+		return normalized
+	}
+	for i, v := range values {
+		normalized[i] = (v - min) / (max - min)
+	}
+	return normalized
+}
+
+// leadingColumnWidth approximates the byte width of a column's values,
+// so a narrow integer leading column is preferred over a wide varchar
+// or a blob-prefixed one when two indices otherwise score the same.
+func leadingColumnWidth(col *model.ColumnInfo) float64 {
+	switch col.FieldType.Tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong,
+		mysql.TypeFloat, mysql.TypeDouble, mysql.TypeYear, mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		return 8
+	case mysql.TypeNewDecimal, mysql.TypeDecimal:
+		return float64(col.FieldType.Flen)
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString:
+		return float64(col.FieldType.Flen)
+	case mysql.TypeBlob, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+		return 1024
+	default:
+		return 16
+	}
+}
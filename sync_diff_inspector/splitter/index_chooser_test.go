@@ -0,0 +1,96 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/source/common"
+)
+
+func intColumn() *model.ColumnInfo {
+	col := &model.ColumnInfo{}
+	col.FieldType.Tp = mysql.TypeLong
+	return col
+}
+
+func wideVarcharColumn(flen int) *model.ColumnInfo {
+	col := &model.ColumnInfo{}
+	col.FieldType.Tp = mysql.TypeVarchar
+	col.FieldType.Flen = flen
+	return col
+}
+
+func manyBuckets(n int) []dbutil.Bucket {
+	return make([]dbutil.Bucket, n)
+}
+
+// TestScoreIndexCandidatesPrefersHigherNDV pins the intended ranking
+// order: with leading-column width held equal, more buckets (a higher
+// NDV proxy) should win.
+func TestScoreIndexCandidatesPrefersHigherNDV(t *testing.T) {
+	table := &common.TableDiff{}
+	candidates := []IndexCandidate{
+		{Index: &model.IndexInfo{}, Columns: []*model.ColumnInfo{intColumn()}, Buckets: manyBuckets(10)},
+		{Index: &model.IndexInfo{}, Columns: []*model.ColumnInfo{intColumn()}, Buckets: manyBuckets(1000)},
+	}
+	scores := scoreIndexCandidates(table, candidates)
+	if scores[1] <= scores[0] {
+		t.Fatalf("expected the higher-NDV candidate (index 1) to score higher: got %v", scores)
+	}
+}
+
+// TestScoreIndexCandidatesNarrowWidthDoesNotSwampNDV pins the bug a
+// previous version of this scoring had: a raw, unnormalized width
+// penalty (up to 1024 for a wide column) could outweigh a raw NDV term
+// that only grows with the candidate's own bucket count, picking the
+// narrower-but-sparser index over the far more selective one. After
+// normalizing both terms across the candidate set, a dramatically
+// higher NDV should still win even against the narrowest possible
+// leading column.
+func TestScoreIndexCandidatesNarrowWidthDoesNotSwampNDV(t *testing.T) {
+	table := &common.TableDiff{}
+	candidates := []IndexCandidate{
+		{Index: &model.IndexInfo{}, Columns: []*model.ColumnInfo{intColumn()}, Buckets: manyBuckets(5)},
+		{Index: &model.IndexInfo{}, Columns: []*model.ColumnInfo{wideVarcharColumn(255)}, Buckets: manyBuckets(5000)},
+	}
+	scores := scoreIndexCandidates(table, candidates)
+	if scores[1] <= scores[0] {
+		t.Fatalf("expected the far-higher-NDV wide-column candidate (index 1) to still win: got %v", scores)
+	}
+}
+
+func TestScoreIndexCandidatesUniqueBreaksTie(t *testing.T) {
+	table := &common.TableDiff{}
+	candidates := []IndexCandidate{
+		{Index: &model.IndexInfo{}, Columns: []*model.ColumnInfo{intColumn()}, Buckets: manyBuckets(10)},
+		{Index: &model.IndexInfo{Unique: true}, Columns: []*model.ColumnInfo{intColumn()}, Buckets: manyBuckets(10)},
+	}
+	scores := scoreIndexCandidates(table, candidates)
+	if scores[1] <= scores[0] {
+		t.Fatalf("expected the unique candidate (index 1) to break the tie: got %v", scores)
+	}
+}
+
+func TestNormalizeScoresAllEqual(t *testing.T) {
+	got := normalizeScores([]float64{5, 5, 5})
+	for _, v := range got {
+		if v != 0 {
+			t.Fatalf("expected all-equal values to normalize to 0, got %v", got)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/chunk"
+)
+
+// SpillConfig controls when a BucketIterator overflows produced chunk
+// batches from memory onto disk, bounding its RAM usage when the
+// consumer of Next() falls behind the producer.
+type SpillConfig struct {
+	// MemLimit is the approximate number of bytes of []*chunk.Range
+	// batches that may be buffered in memory before further batches
+	// are spilled to disk. MemLimit <= 0 disables spilling.
+	MemLimit int64
+	// Dir is the directory used for the temporary spill file. An
+	// empty Dir defaults to os.TempDir().
+	Dir string
+}
+
+// chunkSpiller writes []*chunk.Range batches that overflow the
+// in-memory budget to a single append-only temp file and hands them
+// back out in FIFO order once the producer has caught up. Each record
+// is length-prefixed gob, mirroring the simple framing the rest of
+// this package already uses for chunk data on the wire.
+type chunkSpiller struct {
+	cfg SpillConfig
+
+	mu sync.Mutex
+	// spilling is sticky: once a batch has been spilled, every later
+	// batch spills too, even if it would individually fit under
+	// MemLimit. Without that, a batch produced after a spilled one
+	// could still go straight to chunksCh and be delivered to the
+	// consumer before the earlier, spilled batch is ever read back --
+	// fetchNextBatch only reads the spill file while chunksCh is empty,
+	// so anything still arriving via chunksCh after a spill has already
+	// happened would be delivered out of production order.
+	spilling bool
+	// memUsed tracks bytes of batches currently sitting on chunksCh
+	// waiting to be drained by the consumer, not bytes ever delivered:
+	// trackInMem/untrackInMem keep it live so a fast consumer that
+	// drains chunksCh as quickly as it fills never trips MemLimit, only
+	// a consumer that actually lets batches pile up in memory does.
+	memUsed int64
+	file    *os.File
+	offsets []int64 // file offsets of batches not yet popped, in FIFO order
+	// notify is signaled (non-blockingly) whenever Push adds a batch,
+	// so a consumer parked waiting on chunksCh while spilling is sticky
+	// can wake up and drain the spill file instead of stalling until
+	// the producer finishes.
+	notify chan struct{}
+}
+
+func newChunkSpiller(cfg SpillConfig) (*chunkSpiller, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "bucket-iterator-spill-*.tmp")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &chunkSpiller{cfg: cfg, file: f, notify: make(chan struct{}, 1)}, nil
+}
+
+// shouldSpill reports whether a batch of the given estimated size
+// should be written to disk rather than sent directly on chunksCh,
+// given everything already accounted for as in-memory. Once this
+// returns true for some batch, it keeps returning true for every
+// subsequent batch (see the spilling field), so in-memory and spilled
+// deliveries never interleave out of order.
+func (s *chunkSpiller) shouldSpill(size int64) bool {
+	if s == nil || s.cfg.MemLimit <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spilling {
+		return true
+	}
+	if s.memUsed+size > s.cfg.MemLimit {
+		s.spilling = true
+		return true
+	}
+	return false
+}
+
+func (s *chunkSpiller) trackInMem(size int64) {
+	s.mu.Lock()
+	s.memUsed += size
+	s.mu.Unlock()
+}
+
+// untrackInMem reverses trackInMem once a batch that went straight to
+// chunksCh has actually been drained by the consumer, so memUsed
+// reflects bytes currently resident rather than bytes ever delivered.
+func (s *chunkSpiller) untrackInMem(size int64) {
+	s.mu.Lock()
+	s.memUsed -= size
+	if s.memUsed < 0 {
+		s.memUsed = 0
+	}
+	s.mu.Unlock()
+}
+
+// Push appends chunks to the spill file.
+func (s *chunkSpiller) Push(chunks []*chunk.Range) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(chunks); err != nil {
+		return errors.Trace(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	off, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(buf.Len()))
+	if _, err := s.file.Write(lenBuf[:]); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return errors.Trace(err)
+	}
+	s.offsets = append(s.offsets, off)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pop reads back the oldest spilled batch. It returns (nil, nil) once
+// nothing remains on disk.
+func (s *chunkSpiller) Pop() ([]*chunk.Range, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.offsets) == 0 {
+		return nil, nil
+	}
+	off := s.offsets[0]
+	s.offsets = s.offsets[1:]
+
+	var lenBuf [8]byte
+	if _, err := s.file.ReadAt(lenBuf[:], off); err != nil {
+		return nil, errors.Trace(err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint64(lenBuf[:]))
+	if _, err := s.file.ReadAt(payload, off+int64(len(lenBuf))); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var chunks []*chunk.Range
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&chunks); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return chunks, nil
+}
+
+// Pending reports whether any spilled batches are still waiting to be
+// popped back in.
+func (s *chunkSpiller) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.offsets) > 0
+}
+
+// Close removes the backing temp file.
+func (s *chunkSpiller) Close() error {
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Remove(name))
+}
+
+// estimateChunksSize approximates the memory footprint of a batch of
+// chunk ranges by summing the length of their bound strings, which is
+// what actually dominates their size.
+func estimateChunksSize(chunks []*chunk.Range) int64 {
+	var size int64
+	for _, c := range chunks {
+		for _, b := range c.Bounds {
+			size += int64(len(b.Column) + len(b.Lower) + len(b.Upper))
+		}
+	}
+	return size
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import "testing"
+
+// TestSpillingIsSticky pins down the bug where a small batch produced
+// after a large, spilled one could still pass shouldSpill (since a
+// spilled batch is never counted in memUsed) and be delivered
+// via chunksCh ahead of the earlier, still-spilled batch -- violating
+// production order.
+func TestSpillingIsSticky(t *testing.T) {
+	s := &chunkSpiller{cfg: SpillConfig{MemLimit: 100}}
+
+	if s.shouldSpill(10) {
+		t.Fatalf("small first batch should fit in memory")
+	}
+	s.trackInMem(10)
+
+	if !s.shouldSpill(1000) {
+		t.Fatalf("oversized batch should spill")
+	}
+	// Do NOT trackInMem for the spilled batch -- deliverChunks never does
+	// either, since a spilled batch isn't counted as in-memory.
+
+	if !s.shouldSpill(1) {
+		t.Fatalf("spilling should stay sticky even for a tiny batch that would otherwise fit")
+	}
+}
+
+func TestShouldSpillDisabledWithoutMemLimit(t *testing.T) {
+	s := &chunkSpiller{}
+	if s.shouldSpill(1 << 30) {
+		t.Fatalf("shouldSpill must be a no-op when MemLimit is unset")
+	}
+}
+
+// TestUntrackInMemMakesMemUsedLive pins down that a fast consumer
+// draining chunksCh as quickly as it fills never trips MemLimit: once
+// a batch is untracked after delivery, the same bytes can be
+// accounted for again by a later batch without tripping shouldSpill,
+// instead of memUsed growing as a cumulative bytes-ever-delivered
+// counter that eventually spills everything regardless of how fast
+// the consumer drains.
+func TestUntrackInMemMakesMemUsedLive(t *testing.T) {
+	s := &chunkSpiller{cfg: SpillConfig{MemLimit: 100}}
+
+	for i := 0; i < 5; i++ {
+		if s.shouldSpill(60) {
+			t.Fatalf("iteration %d: batch should fit once the prior one was untracked", i)
+		}
+		s.trackInMem(60)
+		s.untrackInMem(60)
+	}
+}
+
+func TestUntrackInMemNeverGoesNegative(t *testing.T) {
+	s := &chunkSpiller{cfg: SpillConfig{MemLimit: 100}}
+	s.trackInMem(10)
+	s.untrackInMem(100)
+	if s.memUsed != 0 {
+		t.Fatalf("expected memUsed to floor at 0, got %d", s.memUsed)
+	}
+}
+
+// TestPushNotifiesPendingSpill pins down that Push wakes up a consumer
+// parked waiting for a spilled batch, instead of leaving it blocked on
+// chunksCh alone until the producer finishes.
+func TestPushNotifiesPendingSpill(t *testing.T) {
+	s, err := newChunkSpiller(SpillConfig{MemLimit: 1})
+	if err != nil {
+		t.Fatalf("newChunkSpiller: %v", err)
+	}
+	defer s.Close()
+
+	select {
+	case <-s.notify:
+		t.Fatalf("expected no pending notification before any Push")
+	default:
+	}
+
+	if err := s.Push(nil); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	select {
+	case <-s.notify:
+	default:
+		t.Fatalf("expected Push to signal notify")
+	}
+}
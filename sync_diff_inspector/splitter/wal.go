@@ -0,0 +1,373 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/chunk"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/source/common"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/utils"
+	"go.uber.org/zap"
+)
+
+// WALSyncPolicy controls how aggressively the checkpoint WAL fsyncs
+// its segment file.
+type WALSyncPolicy int
+
+const (
+	// WALSyncEveryWrite fsyncs after every record, so a crash never
+	// loses more than the in-flight write. This is the default.
+	WALSyncEveryWrite WALSyncPolicy = iota
+	// WALSyncNever never calls fsync explicitly and relies on the OS
+	// to flush eventually. Faster, less durable.
+	WALSyncNever
+)
+
+// WALOptions configures the checkpoint write-ahead log a BucketIterator
+// uses to remember the last chunk batch its consumer has fully
+// acknowledged via Ack, so a crashed sync_diff run resumes from the
+// last batch actually diffed rather than the last one the producer
+// happened to emit (which may include chunks nobody diffed yet).
+type WALOptions struct {
+	// Dir holds the WAL's segment files. Required.
+	Dir string
+	// SegmentSize rotates to a new segment once the current one
+	// reaches this many bytes. Defaults to defaultWALSegmentSize.
+	SegmentSize int64
+	// SyncPolicy controls fsync behavior. Defaults to WALSyncEveryWrite.
+	SyncPolicy WALSyncPolicy
+}
+
+// WithWALOptions enables a checkpoint write-ahead log: BucketIterator
+// journals a chunk batch once the consumer has acked every chunk in
+// it (see Ack), and NewBucketIteratorWithCheckpoint replays the WAL to
+// resume automatically from the last such batch when the caller
+// doesn't supply its own startRange.
+func WithWALOptions(opts WALOptions) Option {
+	return func(s *BucketIterator) {
+		s.walCfg = &opts
+	}
+}
+
+const (
+	defaultWALSegmentSize = 16 << 20
+	walSegmentPrefix      = "bucket-wal-"
+	// walCompactionInterval is how many records accumulate before the
+	// WAL compacts down to just the latest one; recovery only ever
+	// needs the last record, so older segments are pure overhead.
+	walCompactionInterval = 1000
+)
+
+// walRecord is one checkpointed chunk emission: enough to reconstruct
+// where BucketIterator should resume producing chunks from.
+type walRecord struct {
+	IndexID          int64
+	BucketID         int
+	ChunkID          int
+	UpperBoundValues []string
+	// Done marks the terminal record written after the last chunk of
+	// the whole bucket split: there is no bucket index past the last
+	// one to resume from, so replay should treat this as "already
+	// finished" rather than reconstruct a startRange from BucketID.
+	Done bool
+}
+
+// checkpointWAL is an append-only, segmented, CRC-checked journal of
+// walRecords, modeled on the same "length + CRC, detect a torn tail"
+// framing Prometheus's tsdb WAL uses for crash recovery.
+type checkpointWAL struct {
+	opts WALOptions
+
+	mu      sync.Mutex
+	segment *os.File
+	segSize int64
+	segIdx  int
+	writes  int
+}
+
+func newCheckpointWAL(opts WALOptions) (*checkpointWAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultWALSegmentSize
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	w := &checkpointWAL{opts: opts}
+	if err := w.openOrCreateSegment(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return w, nil
+}
+
+func walSegmentPaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), walSegmentPrefix) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (w *checkpointWAL) openOrCreateSegment() error {
+	paths, err := walSegmentPaths(w.opts.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(paths) == 0 {
+		return w.rotate()
+	}
+
+	last := paths[len(paths)-1]
+	f, err := os.OpenFile(last, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var idx int
+	fmt.Sscanf(filepath.Base(last), walSegmentPrefix+"%06d.log", &idx)
+	w.segment, w.segSize, w.segIdx = f, info.Size(), idx
+	return nil
+}
+
+func (w *checkpointWAL) rotate() error {
+	if w.segment != nil {
+		if err := w.segment.Close(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.segIdx++
+	name := filepath.Join(w.opts.Dir, fmt.Sprintf("%s%06d.log", walSegmentPrefix, w.segIdx))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w.segment, w.segSize = f, 0
+	return nil
+}
+
+// Append writes rec as the next record, rotating to a new segment
+// first if the current one is full, and compacting away older
+// segments every walCompactionInterval writes since only the most
+// recent record is ever needed for recovery.
+func (w *checkpointWAL) Append(rec walRecord) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		return errors.Trace(err)
+	}
+	payload := buf.Bytes()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.segSize >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := w.writeLocked(payload); err != nil {
+		return errors.Trace(err)
+	}
+
+	w.writes++
+	if w.writes%walCompactionInterval == 0 {
+		if err := w.compactLocked(payload); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (w *checkpointWAL) writeLocked(payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	n1, err := w.segment.Write(header[:])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n2, err := w.segment.Write(payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w.segSize += int64(n1 + n2)
+
+	if w.opts.SyncPolicy == WALSyncEveryWrite {
+		return errors.Trace(w.segment.Sync())
+	}
+	return nil
+}
+
+// compactLocked drops every existing segment and starts a fresh one
+// containing only the latest record's payload.
+func (w *checkpointWAL) compactLocked(latestPayload []byte) error {
+	paths, err := walSegmentPaths(w.opts.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.segment.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.segIdx = 0
+	if err := w.rotate(); err != nil {
+		return errors.Trace(err)
+	}
+	return w.writeLocked(latestPayload)
+}
+
+// Close closes the current segment file without removing anything, so
+// the journal can be replayed on the next run.
+func (w *checkpointWAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Trace(w.segment.Close())
+}
+
+// replayLastWALRecord scans every segment in dir in order, validating
+// each record's CRC, and returns the last fully valid record found. A
+// torn tail (a record whose length or CRC doesn't check out, e.g. from
+// a crash mid-write) truncates the scan at that point rather than
+// erroring, matching how Prometheus's tsdb WAL replay tolerates a torn
+// tail instead of treating it as corruption.
+func replayLastWALRecord(dir string) (*walRecord, error) {
+	paths, err := walSegmentPaths(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	var last *walRecord
+	for _, p := range paths {
+		recs, torn, err := readWALSegment(p)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(recs) > 0 {
+			r := recs[len(recs)-1]
+			last = &r
+		}
+		if torn {
+			log.Warn("truncating torn checkpoint WAL tail", zap.String("segment", p))
+			break
+		}
+	}
+	return last, nil
+}
+
+// readWALSegment returns every valid record in path plus whether the
+// segment ended in a torn (incomplete or corrupt) record. A torn tail
+// is cut off the file, so records appended after it by a resumed run
+// are not hidden behind it on the next replay.
+func readWALSegment(path string) ([]walRecord, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	var recs []walRecord
+	off := 0
+	for off+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[off : off+4]))
+		crc := binary.BigEndian.Uint32(data[off+4 : off+8])
+		start := off + 8
+		end := start + length
+		if end > len(data) {
+			break
+		}
+
+		payload := data[start:end]
+		if crc32.ChecksumIEEE(payload) != crc {
+			break
+		}
+
+		var rec walRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		off = end
+	}
+	if off == len(data) {
+		return recs, false, nil
+	}
+	if err := os.Truncate(path, int64(off)); err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	return recs, true, nil
+}
+
+// rangeInfoFromWALRecord turns a replayed walRecord back into the
+// startRange NewBucketIteratorWithCheckpoint expects, so recovery does
+// not depend on the caller having its own checkpoint handy. It relies
+// on RangeInfo's ChunkRange/IndexID fields, the same ones produceChunks
+// already reads off a caller-supplied startRange via GetChunk().
+func rangeInfoFromWALRecord(table *common.TableDiff, rec *walRecord) (*RangeInfo, error) {
+	var index *model.IndexInfo
+	for _, idx := range dbutil.FindAllIndex(table.Info) {
+		if idx != nil && idx.ID == rec.IndexID {
+			index = idx
+			break
+		}
+	}
+	if index == nil {
+		return nil, errors.NotFoundf("index %d referenced by checkpoint WAL", rec.IndexID)
+	}
+
+	columns := utils.GetColumnsFromIndex(index, table.Info)
+	if len(columns) != len(rec.UpperBoundValues) {
+		return nil, errors.Errorf("checkpoint WAL record for index %d has %d bound values, want %d",
+			rec.IndexID, len(rec.UpperBoundValues), len(columns))
+	}
+
+	chunkRange := chunk.NewChunkRange()
+	for i, column := range columns {
+		chunkRange.Update(column.Name.O, "", rec.UpperBoundValues[i], false, true)
+	}
+	chunkRange.BucketID = rec.BucketID
+
+	return &RangeInfo{
+		ChunkRange: chunkRange,
+		IndexID:    rec.IndexID,
+	}, nil
+}
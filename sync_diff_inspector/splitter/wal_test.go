@@ -0,0 +1,133 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckpointWALReplayLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newCheckpointWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("newCheckpointWAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		rec := walRecord{IndexID: 1, BucketID: i, ChunkID: i, UpperBoundValues: []string{"v"}}
+		if err := w.Append(rec); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	replayed, err := replayLastWALRecord(dir)
+	if err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	}
+	if replayed == nil || replayed.BucketID != 2 || replayed.ChunkID != 2 {
+		t.Fatalf("expected last record {BucketID:2,ChunkID:2}, got %+v", replayed)
+	}
+}
+
+func TestCheckpointWALDoneRecordSurvivesReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newCheckpointWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("newCheckpointWAL: %v", err)
+	}
+
+	if err := w.Append(walRecord{IndexID: 1, BucketID: 5, ChunkID: 5}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Append(walRecord{IndexID: 1, Done: true}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	w.Close()
+
+	replayed, err := replayLastWALRecord(dir)
+	if err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	}
+	if replayed == nil || !replayed.Done {
+		t.Fatalf("expected replayed Done record, got %+v", replayed)
+	}
+}
+
+func TestCheckpointWALTornTailIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newCheckpointWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("newCheckpointWAL: %v", err)
+	}
+
+	if err := w.Append(walRecord{IndexID: 1, BucketID: 1, ChunkID: 1}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Append(walRecord{IndexID: 1, BucketID: 2, ChunkID: 2}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	segPath := w.segment.Name()
+	w.Close()
+
+	// Simulate a crash mid-write: truncate off the last few bytes so
+	// the final record's length/CRC header no longer matches the data.
+	info, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.Truncate(segPath, info.Size()-2); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	replayed, err := replayLastWALRecord(dir)
+	if err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	}
+	if replayed == nil || replayed.BucketID != 1 || replayed.ChunkID != 1 {
+		t.Fatalf("expected torn tail to truncate back to {BucketID:1,ChunkID:1}, got %+v", replayed)
+	}
+}
+
+func TestCheckpointWALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newCheckpointWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("newCheckpointWAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < walCompactionInterval; i++ {
+		if err := w.Append(walRecord{IndexID: 1, BucketID: i, ChunkID: i}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	paths, err := walSegmentPaths(dir)
+	if err != nil {
+		t.Fatalf("walSegmentPaths: %v", err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("expected compaction to leave exactly one segment, got %d", len(paths))
+	}
+
+	replayed, err := replayLastWALRecord(dir)
+	if err != nil {
+		t.Fatalf("replayLastWALRecord: %v", err)
+	}
+	if replayed == nil || replayed.BucketID != walCompactionInterval-1 {
+		t.Fatalf("expected last record BucketID=%d, got %+v", walCompactionInterval-1, replayed)
+	}
+}
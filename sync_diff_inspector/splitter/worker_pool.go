@@ -0,0 +1,165 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-tools/sync_diff_inspector/chunk"
+)
+
+// DefaultWorkerPoolSize is the default number of workers used to split
+// buckets concurrently when the caller does not set WithWorkerPoolSize.
+const DefaultWorkerPoolSize = 8
+
+// WithWorkerPoolSize overrides how many workers concurrently call
+// splitRangeByRandom against dbConn while producing chunks. It also
+// caps how many queries are in flight against the DB at once. The
+// default is min(number of split jobs, DefaultWorkerPoolSize), where a
+// split job is one run of merged buckets.
+func WithWorkerPoolSize(n int) Option {
+	return func(s *BucketIterator) {
+		s.workerPoolSize = n
+	}
+}
+
+// splitJob describes one bucket range to be split by a worker.
+type splitJob struct {
+	bucketIdx  int
+	chunkRange *chunk.Range
+	chunkCnt   int
+	count      int64
+}
+
+// splitResult is the outcome of executing a splitJob.
+type splitResult struct {
+	bucketIdx int
+	chunks    []*chunk.Range
+	count     int64
+	err       error
+}
+
+func (s *BucketIterator) effectiveWorkerPoolSize(jobCount int) int {
+	workers := s.workerPoolSize
+	if workers <= 0 {
+		workers = DefaultWorkerPoolSize
+	}
+	if workers > jobCount {
+		workers = jobCount
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// runSplitWorkers starts workers goroutines that each pull splitJobs
+// off jobsCh and call splitRangeByRandom concurrently, publishing
+// results (in arbitrary order) on the returned channel. The returned
+// channel is closed once every worker has drained jobsCh or ctx is
+// canceled.
+func (s *BucketIterator) runSplitWorkers(ctx context.Context, jobsCh <-chan splitJob, workers int) <-chan splitResult {
+	resultsCh := make(chan splitResult, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobsCh {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				chunks, err := splitRangeByRandom(s.dbConn, job.chunkRange, job.chunkCnt,
+					s.table.Schema, s.table.Table, s.indexColumns, s.table.Range, s.table.Collation)
+
+				select {
+				case resultsCh <- splitResult{bucketIdx: job.bucketIdx, chunks: chunks, count: job.count, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resultsCh)
+	}()
+
+	return resultsCh
+}
+
+// runSplitJobs dispatches jobs (already ordered by bucketIdx) to a
+// worker pool, then reorders the results back into bucketIdx order
+// before handing each batch to sendChunks -- Next() still has to see
+// chunks in bucket order for checkpoint semantics to stay monotonic,
+// even though the DB queries that produced them ran concurrently.
+// *chunkID is advanced exactly as the sequential path always did.
+func (s *BucketIterator) runSplitJobs(ctx context.Context, jobs []splitJob, chunkID *int) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	splitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobsCh := make(chan splitJob, len(jobs))
+	order := make([]int, len(jobs))
+	for i, job := range jobs {
+		jobsCh <- job
+		order[i] = job.bucketIdx
+	}
+	close(jobsCh)
+
+	resultsCh := s.runSplitWorkers(splitCtx, jobsCh, s.effectiveWorkerPoolSize(len(jobs)))
+
+	pending := make(map[int]splitResult, len(jobs))
+	nextIdx := 0
+	for remaining := len(jobs); remaining > 0; {
+		select {
+		case res, ok := <-resultsCh:
+			if !ok {
+				return nil
+			}
+			if res.err != nil {
+				return errors.Trace(res.err)
+			}
+			remaining--
+			pending[res.bucketIdx] = res
+
+			for nextIdx < len(order) {
+				res, ok := pending[order[nextIdx]]
+				if !ok {
+					break
+				}
+				delete(pending, order[nextIdx])
+				nextIdx++
+
+				*chunkID = chunk.InitChunks(res.chunks, chunk.Bucket, *chunkID, res.bucketIdx, s.table.Collation, s.table.Range)
+				s.recordExpectedRows(res.chunks, res.count)
+				if !s.sendChunks(ctx, res.chunks, res.bucketIdx, *chunkID) {
+					return nil
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splitter
+
+import "testing"
+
+func TestEffectiveWorkerPoolSize(t *testing.T) {
+	cases := []struct {
+		configured, jobs, want int
+	}{
+		{0, 20, DefaultWorkerPoolSize},
+		{3, 20, 3},
+		{20, 5, 5},
+		{5, 0, 1},
+	}
+	for _, c := range cases {
+		s := &BucketIterator{workerPoolSize: c.configured}
+		if got := s.effectiveWorkerPoolSize(c.jobs); got != c.want {
+			t.Fatalf("effectiveWorkerPoolSize(configured=%d, jobs=%d) = %d, want %d",
+				c.configured, c.jobs, got, c.want)
+		}
+	}
+}